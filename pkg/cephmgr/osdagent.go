@@ -16,13 +16,17 @@ limitations under the License.
 package cephmgr
 
 import (
+	"crypto/rand"
+	"encoding/base64"
 	"fmt"
 	"log"
 	"os"
+	"os/exec"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -42,17 +46,46 @@ const (
 	deviceKey       = "device"
 	dirKey          = "dir"
 	unassignedOSDID = -1
+
+	// encryption modes supported for OSD devices, mirroring ceph-disk's dm-crypt support
+	encryptionModeLUKS  = "luks"
+	encryptionModePlain = "plain"
+
+	// config-key path under which the per-OSD dm-crypt key is stored in the mon
+	dmCryptKeyConfigKeyFormat = "dm-crypt/osd/%s/luks"
+
+	// GPT partition typecodes for the dm-crypt roles, as used by ceph-disk's lockbox scheme
+	gptTypecodeLUKSLockbox = "fb3aabf9-d25f-47cc-bf5e-721d1816496b"
+	gptTypecodeLUKSData    = "6dfd4440-f8d2-4370-1d7e-7ac6702af3b9"
+	gptTypecodeLUKSJournal = "45b0969e-9b03-4f30-1d7e-7ac6702af3b9"
+
+	// GPT partition typecode ceph-disk assigns to a plain (non-dm-crypt) ceph data partition
+	gptTypecodeCephData = "4fbd7e29-9d25-41b8-afd0-062c0ceff05d"
+
+	// GPT partition typecode assigned to a bluestore DB/WAL partition carved out of a shared
+	// fast device, mirroring ceph-volume's block.db typecode
+	gptTypecodeCephBlockDB = "30cd0809-c2b2-499c-8879-2d6b785292be"
 )
 
 type osdAgent struct {
-	cluster       *ClusterInfo
-	forceFormat   bool
-	location      string
-	factory       client.ConnectionFactory
-	osdProc       map[int]*proc.MonitoredProc
-	devices       string
-	configCounter int32
-	osdsCompleted chan struct{}
+	cluster         *ClusterInfo
+	forceFormat     bool
+	location        string
+	factory         client.ConnectionFactory
+	osdProc         map[int]*proc.MonitoredProc
+	devices         string
+	configCounter   int32
+	osdsCompleted   chan struct{}
+	encryptedDevice bool
+	encryptionMode  string
+	osdLock         *clusterd.EtcdMutex
+	osdLockMutex    sync.Mutex
+
+	// stoppingOSDs tracks the ids of osds whose process is being stopped intentionally (e.g. by
+	// removeOSD or ReplaceOSD), so watchOSDProcess can tell that exit apart from a genuine crash
+	// and avoid overwriting a status the stopper is about to set itself.
+	stoppingOSDs  map[int]bool
+	stoppingMutex sync.Mutex
 }
 
 type osdInfo struct {
@@ -62,12 +95,41 @@ type osdInfo struct {
 }
 
 type osdConfig struct {
-	deviceName string
-	rootPath   string
-	id         int
-	uuid       uuid.UUID
-	diskUUID   string
-	bluestore  bool
+	deviceName     string
+	rootPath       string
+	id             int
+	uuid           uuid.UUID
+	diskUUID       string
+	bluestore      bool
+	encrypted      bool
+	encryptionMode string
+
+	// databaseDevice and walDevice carve out a partition on a shared fast device for the bluestore
+	// DB/WAL of this (slower) OSD, as opposed to colocating them with the data on deviceName.
+	databaseDevice   string
+	databaseSizeMB   int
+	databasePartUUID string
+	walDevice        string
+	walSizeMB        int
+	walPartUUID      string
+
+	// adopted is true when the device was found to already carry a prepared OSD (e.g. after a
+	// node re-image) and was activated in place rather than formatted from scratch.
+	adopted bool
+}
+
+// desiredDeviceConfig is the parsed form of a desired device entry, extending the plain
+// device->osdID mapping with an optional shared DB/WAL device layout (mirroring ceph-volume's
+// "batch" prepare flow and the ext_db_ratio/ext_db_size/split_count options).
+type desiredDeviceConfig struct {
+	name      string
+	osdID     int
+	dbDevice  string
+	dbSizeMB  int
+	dbRatio   float64
+	dbSplit   int
+	walDevice string
+	walSizeMB int
 }
 
 func newOSDAgent(factory client.ConnectionFactory, devices string, forceFormat bool, location string) *osdAgent {
@@ -142,6 +204,10 @@ func (a *osdAgent) ConfigureLocalService(context *clusterd.Context) error {
 		return err
 	}
 
+	if err := a.processDesiredReplacements(context, adminConn); err != nil {
+		return err
+	}
+
 	return a.stopUndesiredDevices(context, adminConn)
 }
 
@@ -192,10 +258,14 @@ func (a *osdAgent) decrementConfigCounter() {
 }
 
 func (a *osdAgent) stopUndesiredDevices(context *clusterd.Context, connection client.Connection) error {
-	desiredDevices, err := loadDesiredDevices(context.EtcdClient, context.NodeID)
+	desiredDeviceConfigs, err := loadDesiredDeviceConfigs(context.EtcdClient, context.NodeID)
 	if err != nil {
 		return fmt.Errorf("failed to load desired devices. %v", err)
 	}
+	desiredDevices := map[string]int{}
+	for name, cfg := range desiredDeviceConfigs {
+		desiredDevices[name] = cfg.osdID
+	}
 
 	desiredDirs, err := loadDesiredDirs(context.EtcdClient, context.NodeID)
 	if err != nil {
@@ -234,6 +304,12 @@ func (a *osdAgent) stopUndesiredDevices(context *clusterd.Context, connection cl
 }
 
 func (a *osdAgent) removeOSD(context *clusterd.Context, connection client.Connection, id int) error {
+	// guard against another agent racing to configure/remove osds for this same node
+	lock := a.getOSDLock(context)
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("failed to acquire osd lock. %v", err)
+	}
+	defer lock.Unlock()
 
 	// mark the OSD as out of the cluster so its data starts to migrate
 	err := markOSDOut(connection, id)
@@ -244,6 +320,7 @@ func (a *osdAgent) removeOSD(context *clusterd.Context, connection client.Connec
 	// stop the osd process if running
 	proc, ok := a.osdProc[id]
 	if ok {
+		a.markOSDStopping(id)
 		err := proc.Stop()
 		if err != nil {
 			log.Printf("failed to stop osd %d. %v", id, err)
@@ -253,6 +330,36 @@ func (a *osdAgent) removeOSD(context *clusterd.Context, connection client.Connec
 		delete(a.osdProc, id)
 	}
 
+	if osdUUID, encrypted, err := getAppliedEncryption(context, id); err != nil {
+		log.Printf("failed to determine encryption state for osd %d. %v", id, err)
+	} else if encrypted {
+		// close the mapper device and purge the key from the mon so the device can be reused
+		if err := closeDmCryptDevice(context, osdUUID); err != nil {
+			log.Printf("failed to close dm-crypt device for osd %d. %v", id, err)
+		}
+		if err := purgeDmCryptKey(connection, osdUUID); err != nil {
+			log.Printf("failed to purge dm-crypt key for osd %d. %v", id, err)
+		}
+	}
+
+	// free any DB/WAL partitions carved out of a shared device back to their pool
+	if dbDevice, err := getAppliedSetting(context, id, "db-device"); err != nil {
+		log.Printf("failed to determine db device for osd %d. %v", id, err)
+	} else if dbDevice != "" {
+		partUUID, _ := getAppliedPartUUID(context, id, "db-part-uuid")
+		if err := freeDBPartition(context, dbDevice, partUUID); err != nil {
+			log.Printf("failed to free db partition for osd %d. %v", id, err)
+		}
+	}
+	if walDevice, err := getAppliedSetting(context, id, "wal-device"); err != nil {
+		log.Printf("failed to determine wal device for osd %d. %v", id, err)
+	} else if walDevice != "" {
+		partUUID, _ := getAppliedPartUUID(context, id, "wal-part-uuid")
+		if err := freeDBPartition(context, walDevice, partUUID); err != nil {
+			log.Printf("failed to free wal partition for osd %d. %v", id, err)
+		}
+	}
+
 	err = purgeOSD(connection, id)
 	if err != nil {
 		return fmt.Errorf("faild to remove osd %d from crush map. %v", id, err)
@@ -266,20 +373,215 @@ func (a *osdAgent) removeOSD(context *clusterd.Context, connection client.Connec
 		return err
 	}
 
+	if err := setOSDStatus(context, id, osdPhaseRemoved, nil); err != nil {
+		log.Printf("failed to update status for osd %d. %v", id, err)
+	}
+
 	log.Printf("Stopped and removed osd device %d", id)
 
 	return nil
 }
 
+// getDesiredReplaceKey returns the etcd directory under which pending osd replacements for a node
+// are requested, keyed by the osd id being replaced.
+func getDesiredReplaceKey(nodeID string) string {
+	return path.Join(cephKey, osdAgentName, desiredKey, nodeID, "replace")
+}
+
+// SetDesiredReplace requests that the given osd be replaced with newDevice the next time the agent
+// on nodeID orchestrates, preserving the osd's id, CRUSH bucket and weight.
+func SetDesiredReplace(etcdClient etcd.KeysAPI, nodeID string, osdID int, newDevice string) error {
+	key := path.Join(getDesiredReplaceKey(nodeID), fmt.Sprintf("%d", osdID))
+	_, err := etcdClient.Set(ctx.Background(), key, newDevice, nil)
+	return err
+}
+
+// loadDesiredReplaces returns the pending osd replacements for a node, mapping osd id to the new
+// device it should be moved onto.
+func loadDesiredReplaces(etcdClient etcd.KeysAPI, nodeID string) (map[int]string, error) {
+	replaces := map[int]string{}
+	replaceNodes, err := etcdClient.Get(ctx.Background(), getDesiredReplaceKey(nodeID), &etcd.GetOptions{Recursive: true})
+	if err != nil {
+		if util.IsEtcdKeyNotFound(err) {
+			return replaces, nil
+		}
+		return nil, err
+	}
+
+	for _, osdNode := range replaceNodes.Node.Nodes {
+		id, err := strconv.Atoi(util.GetLeafKeyPath(osdNode.Key))
+		if err != nil {
+			continue
+		}
+		replaces[id] = osdNode.Value
+	}
+
+	return replaces, nil
+}
+
+// processDesiredReplacements carries out any osd replacements requested against this node, clearing
+// each one from desired state once it completes.
+func (a *osdAgent) processDesiredReplacements(context *clusterd.Context, connection client.Connection) error {
+	replaces, err := loadDesiredReplaces(context.EtcdClient, context.NodeID)
+	if err != nil {
+		return fmt.Errorf("failed to load desired osd replacements. %v", err)
+	}
+
+	var lastErr error
+	for osdID, newDevice := range replaces {
+		log.Printf("replacing osd %d with device %s", osdID, newDevice)
+		if err := a.ReplaceOSD(context, connection, osdID, newDevice); err != nil {
+			log.Printf("ERROR: failed to replace osd %d with device %s. %+v", osdID, newDevice, err)
+			lastErr = err
+			continue
+		}
+
+		key := path.Join(getDesiredReplaceKey(context.NodeID), fmt.Sprintf("%d", osdID))
+		if _, err := context.EtcdClient.Delete(ctx.Background(), key, nil); err != nil {
+			log.Printf("failed to clear desired replacement for osd %d. %v", osdID, err)
+		}
+	}
+
+	return lastErr
+}
+
+// ReplaceOSD swaps the device backing an existing osd without a full CRUSH rebalance: the osd is
+// marked out and stopped like removeOSD, but purgeOSD is skipped so its id, CRUSH bucket and weight
+// are preserved. newDevice is wiped/formatted and initialized as the same osd id, then the daemon is
+// restarted against it. This mirrors the PVC Ceph worker's osd.replace task.
+func (a *osdAgent) ReplaceOSD(context *clusterd.Context, connection client.Connection, osdID int, newDevice string) error {
+	// hold the distributed osd lock for this node so a concurrent configureDevices pass (or
+	// another agent during a rolling restart/HA takeover) can't act on osdProc/the device at the
+	// same time as this replace
+	lock := a.getOSDLock(context)
+	if err := lock.Lock(); err != nil {
+		return fmt.Errorf("failed to acquire osd lock. %+v", err)
+	}
+	defer lock.Unlock()
+
+	if err := markOSDOut(connection, osdID); err != nil {
+		return fmt.Errorf("failed to mark out osd %d. %v", osdID, err)
+	}
+
+	if proc, ok := a.osdProc[osdID]; ok {
+		a.markOSDStopping(osdID)
+		if err := proc.Stop(); err != nil {
+			return fmt.Errorf("failed to stop osd %d. %v", osdID, err)
+		}
+		delete(a.osdProc, osdID)
+	}
+
+	configRoot, err := getAppliedSetting(context, osdID, "path")
+	if err != nil {
+		return fmt.Errorf("failed to load config path for osd %d. %v", osdID, err)
+	}
+	if configRoot == "" {
+		configRoot = context.ConfigDir
+	}
+
+	config := &osdConfig{deviceName: newDevice, bluestore: true,
+		encrypted: a.encryptedDevice, encryptionMode: a.encryptionMode}
+	if err := registerOSDWithID(connection, config, osdID); err != nil {
+		return fmt.Errorf("failed to re-register osd %d against %s. %v", osdID, newDevice, err)
+	}
+
+	config.rootPath = path.Join(configRoot, fmt.Sprintf("osd%d", config.id))
+	if err := os.RemoveAll(config.rootPath); err != nil {
+		return fmt.Errorf("failed to clear old osd %d config at %s: %+v", config.id, config.rootPath, err)
+	}
+	if err := os.MkdirAll(config.rootPath, 0744); err != nil {
+		return fmt.Errorf("failed to make osd %d config at %s: %+v", config.id, config.rootPath, err)
+	}
+
+	if config.encrypted {
+		// provision dm-crypt on the replacement device too, the same as a freshly created osd,
+		// otherwise the replaced osd would silently come back unencrypted
+		if err := a.prepareEncryptedDevice(context, connection, config); err != nil {
+			return fmt.Errorf("failed to encrypt replacement device %s for osd %d. %+v", newDevice, config.id, err)
+		}
+	}
+
+	if err := formatDevice(context, config, true); err != nil {
+		return fmt.Errorf("failed to format replacement device %s for osd %d. %+v", newDevice, config.id, err)
+	}
+
+	log.Printf("waiting after bluestore partition/format...")
+	<-time.After(2 * time.Second)
+
+	if err := initializeOSD(config, a.factory, context, connection, a.cluster, a.location, context.Debug, context.Executor); err != nil {
+		return fmt.Errorf("failed to initialize replacement osd %d: %+v", config.id, err)
+	}
+
+	settings := map[string]string{
+		"path":      configRoot,
+		"disk-uuid": config.diskUUID,
+		"osd-uuid":  config.uuid.String(),
+	}
+	if config.encrypted {
+		settings["encrypted"] = "1"
+		settings["encryption-mode"] = config.encryptionMode
+	}
+	key := path.Join(getAppliedKey(context.NodeID), fmt.Sprintf("%d", config.id))
+	if err := util.StoreEtcdProperties(context.EtcdClient, key, settings); err != nil {
+		return fmt.Errorf("failed to mark osd %d as applied: %+v", config.id, err)
+	}
+
+	if err := a.runOSD(context, a.cluster.Name, config); err != nil {
+		return fmt.Errorf("failed to run replacement osd %d: %+v", config.id, err)
+	}
+
+	return nil
+}
+
+// registerOSDWithID is a variant of registerOSD that reuses an already-assigned osd id instead of
+// allocating a new one, via "ceph osd new <uuid> <id>", so a disk swap doesn't move the osd to a new
+// id/CRUSH slot.
+func registerOSDWithID(connection client.Connection, config *osdConfig, existingID int) error {
+	osdUUID, err := uuid.NewRandom()
+	if err != nil {
+		return fmt.Errorf("failed to generate osd uuid. %+v", err)
+	}
+
+	args := []string{"osd", "new", osdUUID.String(), fmt.Sprintf("%d", existingID)}
+	if _, _, err := client.ExecuteMonCommand(connection, args...); err != nil {
+		return fmt.Errorf("failed to register osd %d. %+v", existingID, err)
+	}
+
+	config.id = existingID
+	config.uuid = osdUUID
+	return nil
+}
+
 func (a *osdAgent) DestroyLocalService(context *clusterd.Context) error {
 	// stop the OSD processes
 	for id, proc := range a.osdProc {
 		log.Printf("stopping osd %d", id)
+		a.markOSDStopping(id)
 		proc.Stop()
 	}
 
 	// clear out the osd procs
 	a.osdProc = map[int]*proc.MonitoredProc{}
+
+	// wait for any in-flight configureDevices pass to finish before releasing the osd lock below,
+	// otherwise the lock could be released while that goroutine is still formatting/initializing
+	// devices, letting a second agent acquire it and configure the same devices concurrently
+	if a.osdsCompleted != nil {
+		<-a.osdsCompleted
+	}
+
+	// release the distributed osd lock if this agent is still holding it. a.osdLock is read under
+	// osdLockMutex since it's also lazily created by getOSDLock from the configureDevices goroutine.
+	a.osdLockMutex.Lock()
+	lock := a.osdLock
+	a.osdLockMutex.Unlock()
+
+	if lock != nil {
+		if err := lock.Unlock(); err != nil {
+			log.Printf("failed to release osd lock. %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -287,9 +589,47 @@ func getAppliedKey(nodeID string) string {
 	return path.Join(cephKey, osdAgentName, appliedKey, nodeID)
 }
 
+// getOSDLock returns the distributed lock guarding osd orchestration for this node, keyed so that
+// two agents racing to configure the same node (e.g. during a rolling restart or HA takeover of the
+// rook operator) don't double-prepare the same device. The lock is created lazily and reused for
+// the lifetime of the agent.
+func (a *osdAgent) getOSDLock(context *clusterd.Context) *clusterd.EtcdMutex {
+	a.osdLockMutex.Lock()
+	defer a.osdLockMutex.Unlock()
+
+	if a.osdLock == nil {
+		key := path.Join(cephKey, osdAgentName, "lock", context.NodeID)
+		a.osdLock = clusterd.NewEtcdMutex(context.EtcdClient, key, context.NodeID)
+	}
+
+	return a.osdLock
+}
+
+// markOSDStopping records that osdID's process is about to be stopped on purpose, so the
+// watchOSDProcess goroutine watching it knows not to report the exit as a failure.
+func (a *osdAgent) markOSDStopping(osdID int) {
+	a.stoppingMutex.Lock()
+	defer a.stoppingMutex.Unlock()
+
+	if a.stoppingOSDs == nil {
+		a.stoppingOSDs = map[int]bool{}
+	}
+	a.stoppingOSDs[osdID] = true
+}
+
+// clearOSDStopping reports whether osdID was marked as stopping intentionally, clearing the mark.
+func (a *osdAgent) clearOSDStopping(osdID int) bool {
+	a.stoppingMutex.Lock()
+	defer a.stoppingMutex.Unlock()
+
+	wasStopping := a.stoppingOSDs[osdID]
+	delete(a.stoppingOSDs, osdID)
+	return wasStopping
+}
+
 // create and initalize OSDs for all the devices specified in the given config
 func (a *osdAgent) createDesiredOSDs(adminConn client.Connection, context *clusterd.Context) error {
-	devices, err := loadDesiredDevices(context.EtcdClient, context.NodeID)
+	devices, err := loadDesiredDeviceConfigs(context.EtcdClient, context.NodeID)
 	if err != nil {
 		return fmt.Errorf("failed to load desired devices. %v", err)
 	}
@@ -349,7 +689,7 @@ func (a *osdAgent) getBoostrapOSDConnection(context *clusterd.Context) (client.C
 		getBootstrapOSDKeyringPath(context.ConfigDir, a.cluster.Name), context.Debug)
 }
 
-func (a *osdAgent) configureDevices(context *clusterd.Context, devices map[string]int) error {
+func (a *osdAgent) configureDevices(context *clusterd.Context, devices map[string]*desiredDeviceConfig) error {
 	if len(devices) == 0 {
 		return nil
 	}
@@ -370,10 +710,35 @@ func (a *osdAgent) configureDevices(context *clusterd.Context, devices map[strin
 		a.incrementConfigCounter()
 		defer a.decrementConfigCounter()
 
+		// hold the distributed osd lock for this node for the entire configuration pass so a
+		// second agent (e.g. during a rolling restart or HA takeover) can't prepare the same
+		// devices concurrently
+		lock := a.getOSDLock(context)
+		if err := lock.Lock(); err != nil {
+			log.Printf("ERROR: failed to acquire osd lock. %+v", err)
+			close(a.osdsCompleted)
+			return
+		}
+		defer lock.Unlock()
+
 		// initialize all the desired OSD volumes
 		succeeded := 0
-		for device, osdID := range devices {
-			config := &osdConfig{id: osdID, deviceName: device, bluestore: true}
+		for device, deviceConfig := range devices {
+			config := &osdConfig{id: deviceConfig.osdID, deviceName: device, bluestore: true,
+				encrypted: a.encryptedDevice, encryptionMode: a.encryptionMode}
+			if deviceConfig.dbDevice != "" {
+				sizeMB, err := resolveDBSizeMB(context, deviceConfig.dbDevice, deviceConfig.dbSizeMB, deviceConfig.dbRatio, deviceConfig.dbSplit)
+				if err != nil {
+					log.Printf("ERROR: failed to resolve db partition size on %s. %+v", device, err)
+					continue
+				}
+				config.databaseDevice = deviceConfig.dbDevice
+				config.databaseSizeMB = sizeMB
+			}
+			if deviceConfig.walDevice != "" {
+				config.walDevice = deviceConfig.walDevice
+				config.walSizeMB = deviceConfig.walSizeMB
+			}
 			err := a.createOrStartOSD(context, connection, config, context.ConfigDir, false)
 			if err != nil {
 				log.Printf("ERROR: failed to config osd on device %s. %+v", device, err)
@@ -392,23 +757,47 @@ func (a *osdAgent) configureDevices(context *clusterd.Context, devices map[strin
 }
 
 func (a *osdAgent) createOrStartOSD(context *clusterd.Context, connection client.Connection, config *osdConfig, configRoot string, dir bool) error {
-	// create a new OSD in ceph unless already done previously
-	if config.id == unassignedOSDID {
-		err := registerOSD(connection, config)
+	// the device name tracked in desired state, captured before probeExistingOSD below can rewrite
+	// config.deviceName to a dm-crypt mapper path for an adopted encrypted device
+	desiredDeviceName := config.deviceName
+
+	// before creating a brand new OSD, check whether the device already carries a previously
+	// prepared one (e.g. after a node re-image, or moved from another host) so it isn't
+	// reformatted and its data lost
+	if config.id == unassignedOSDID && config.bluestore && !a.forceFormat {
+		adopted, err := probeExistingOSD(context, connection, config)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to probe device %s for an existing osd. %+v", desiredDeviceName, err)
 		}
-
-		name := config.deviceName
-		if dir {
-			name = configRoot
+		if adopted {
+			log.Printf("found existing osd %d on device %s, adopting it instead of reformatting", config.id, desiredDeviceName)
 		}
-		err = setOSDOnDevice(context.EtcdClient, context.NodeID, name, config.id, dir)
+	}
+
+	// create a new OSD in ceph unless already done previously. note that probeExistingOSD above
+	// may have already populated config.id for an adopted device, so recording the device->osdID
+	// mapping below isn't gated on config.id == unassignedOSDID: it still needs to be recorded as
+	// desired state for the adopted id too, otherwise stopUndesiredDevices has no way to know
+	// this osd is wanted and will tear it straight back down as "applied but not desired".
+	if config.id == unassignedOSDID {
+		err := registerOSD(connection, config)
 		if err != nil {
 			return err
 		}
 	}
 
+	name := desiredDeviceName
+	if dir {
+		name = configRoot
+	}
+	if err := setOSDOnDevice(context.EtcdClient, context.NodeID, name, config.id, dir); err != nil {
+		return err
+	}
+
+	if err := setOSDStatus(context, config.id, osdPhasePreparing, nil); err != nil {
+		log.Printf("failed to update status for osd %d. %v", config.id, err)
+	}
+
 	newOSD := false
 	config.rootPath = path.Join(configRoot, fmt.Sprintf("osd%d", config.id))
 	if isOSDDataNotExist(config.rootPath) {
@@ -422,27 +811,84 @@ func (a *osdAgent) createOrStartOSD(context *clusterd.Context, connection client
 	}
 
 	if newOSD {
-		if config.bluestore {
-			// the device needs to be formatted
-			err := formatDevice(context, config, a.forceFormat)
-			if err != nil {
-				return fmt.Errorf("failed device %s. %+v", config.deviceName, err)
+		if config.adopted {
+			// the device is already a prepared OSD; activate it into the new rootPath instead of
+			// formatting over it and losing its data
+			if err := activateAdoptedDevice(context, config); err != nil {
+				return fmt.Errorf("failed to activate adopted osd %d at %s: %+v", config.id, config.rootPath, err)
+			}
+		} else {
+			if config.databaseDevice != "" {
+				// carve the next free DB partition out of the shared fast device for this OSD
+				partUUID, err := allocateDBPartition(context, config.databaseDevice, config.databaseSizeMB)
+				if err != nil {
+					return fmt.Errorf("failed to allocate db partition on %s. %+v", config.databaseDevice, err)
+				}
+				config.databasePartUUID = partUUID
 			}
 
-			log.Printf("waiting after bluestore partition/format...")
-			<-time.After(2 * time.Second)
-		}
+			if config.walDevice != "" {
+				partUUID, err := allocateDBPartition(context, config.walDevice, config.walSizeMB)
+				if err != nil {
+					return fmt.Errorf("failed to allocate wal partition on %s. %+v", config.walDevice, err)
+				}
+				config.walPartUUID = partUUID
+			}
 
-		// osd_data_dir/whoami does not exist yet, create/initialize the OSD
-		err := initializeOSD(config, a.factory, context, connection, a.cluster, a.location, context.Debug, context.Executor)
-		if err != nil {
-			return fmt.Errorf("failed to initialize OSD at %s: %+v", config.rootPath, err)
+			if config.encrypted && config.bluestore {
+				// provision dm-crypt on top of the raw device before it is formatted, storing the
+				// per-OSD key in the mon config-key store so it can be retrieved again on restart
+				if err := a.prepareEncryptedDevice(context, connection, config); err != nil {
+					return fmt.Errorf("failed to encrypt device %s. %+v", config.deviceName, err)
+				}
+			}
+
+			if config.bluestore {
+				// the device needs to be formatted
+				if err := setOSDStatus(context, config.id, osdPhaseFormatting, nil); err != nil {
+					log.Printf("failed to update status for osd %d. %v", config.id, err)
+				}
+				err := formatDevice(context, config, a.forceFormat)
+				if err != nil {
+					setOSDStatus(context, config.id, osdPhaseFailed, err)
+					return fmt.Errorf("failed device %s. %+v", config.deviceName, err)
+				}
+
+				log.Printf("waiting after bluestore partition/format...")
+				<-time.After(2 * time.Second)
+			}
+
+			// osd_data_dir/whoami does not exist yet, create/initialize the OSD
+			if err := setOSDStatus(context, config.id, osdPhaseInitializing, nil); err != nil {
+				log.Printf("failed to update status for osd %d. %v", config.id, err)
+			}
+			err := initializeOSD(config, a.factory, context, connection, a.cluster, a.location, context.Debug, context.Executor)
+			if err != nil {
+				setOSDStatus(context, config.id, osdPhaseFailed, err)
+				return fmt.Errorf("failed to initialize OSD at %s: %+v", config.rootPath, err)
+			}
 		}
 
 		// save the osd to applied state
 		settings := map[string]string{
 			"path":      configRoot,
 			"disk-uuid": config.diskUUID,
+			"osd-uuid":  config.uuid.String(),
+		}
+		if config.encrypted {
+			settings["encrypted"] = "1"
+			settings["encryption-mode"] = config.encryptionMode
+		}
+		if config.databasePartUUID != "" {
+			settings["db-device"] = config.databaseDevice
+			settings["db-part-uuid"] = config.databasePartUUID
+		}
+		if config.walPartUUID != "" {
+			settings["wal-device"] = config.walDevice
+			settings["wal-part-uuid"] = config.walPartUUID
+		}
+		if config.adopted {
+			settings["adopted"] = "1"
 		}
 		key := path.Join(getAppliedKey(context.NodeID), fmt.Sprintf("%d", config.id))
 		if err := util.StoreEtcdProperties(context.EtcdClient, key, settings); err != nil {
@@ -456,6 +902,31 @@ func (a *osdAgent) createOrStartOSD(context *clusterd.Context, connection client
 		if err != nil {
 			return fmt.Errorf("failed to get OSD information from %s: %+v", config.rootPath, err)
 		}
+
+		// restore the DB/WAL partition already allocated for this osd on a previous run, rather
+		// than allocating a fresh one from the shared device's pool
+		if config.databaseDevice != "" {
+			if partUUID, err := getAppliedPartUUID(context, config.id, "db-part-uuid"); err != nil {
+				return fmt.Errorf("failed to load db partition for osd %d. %+v", config.id, err)
+			} else {
+				config.databasePartUUID = partUUID
+			}
+		}
+		if config.walDevice != "" {
+			if partUUID, err := getAppliedPartUUID(context, config.id, "wal-part-uuid"); err != nil {
+				return fmt.Errorf("failed to load wal partition for osd %d. %+v", config.id, err)
+			} else {
+				config.walPartUUID = partUUID
+			}
+		}
+
+		if config.encrypted && config.bluestore {
+			// the mapper is closed on every process restart, so re-open it from the key
+			// stored in the mon before the osd daemon can be started again
+			if err := a.reopenEncryptedDevice(context, connection, config); err != nil {
+				return fmt.Errorf("failed to reopen encrypted device for osd %d. %+v", config.id, err)
+			}
+		}
 	}
 
 	// run the OSD in a child process now that it is fully initialized and ready to go
@@ -467,6 +938,152 @@ func (a *osdAgent) createOrStartOSD(context *clusterd.Context, connection client
 	return nil
 }
 
+// probeExistingOSD checks whether config.deviceName already carries a previously prepared Ceph OSD
+// by reading its GPT partition typecode and bluestore superblock/ceph_fsid labels, analogous to
+// ceph-disk's is_osd_disk/is_active_bluestore_device checks. If a valid OSD is found, config.id,
+// config.uuid and config.diskUUID are populated from the on-disk metadata and config.adopted is set
+// so the caller activates the device in place instead of formatting over it. A device whose raw
+// partition is itself dm-crypt'd (gptTypecodeLUKS*) is unlocked with its mon-stored key before its
+// bluestore label is read, so encrypted OSDs are recognized across reboots the same as plain ones.
+func probeExistingOSD(context *clusterd.Context, connection client.Connection, config *osdConfig) (bool, error) {
+	typecode, err := readPartitionTypecode(context, config.deviceName)
+	if err != nil {
+		return false, nil
+	}
+
+	device := config.deviceName
+	encrypted := false
+
+	switch {
+	case typecode == gptTypecodeCephData:
+		// plain bluestore data partition, nothing to unlock
+
+	case isLUKSTypecode(typecode):
+		partUUID, err := readPartitionUUID(context, config.deviceName)
+		if err != nil || partUUID == "" {
+			return false, nil
+		}
+		osdUUID, err := uuid.Parse(partUUID)
+		if err != nil {
+			return false, nil
+		}
+
+		if dmCryptMapperExists(osdUUID) {
+			// already open from a previous probe/run in this process lifetime
+			device = dmCryptMapperPath(osdUUID)
+		} else {
+			key, err := fetchDmCryptKey(connection, osdUUID)
+			if err != nil || key == "" {
+				// no key stored in the mon for this partition; not a device we previously prepared
+				return false, nil
+			}
+
+			mapperPath, err := luksOpen(context, config.deviceName, osdUUID, key)
+			if err != nil {
+				return false, fmt.Errorf("failed to luksOpen adopted device %s. %+v", config.deviceName, err)
+			}
+
+			device = mapperPath
+		}
+
+		encrypted = true
+		config.uuid = osdUUID
+
+	default:
+		// unreadable or not a recognized ceph/LUKS data partition; treat the device as blank
+		return false, nil
+	}
+
+	fsid, err := readBluestoreLabel(context, device, "ceph_fsid")
+	if err != nil || fsid == "" {
+		return false, nil
+	}
+
+	whoami, err := readBluestoreLabel(context, device, "whoami")
+	if err != nil || whoami == "" {
+		return false, nil
+	}
+	osdID, err := strconv.Atoi(whoami)
+	if err != nil {
+		return false, fmt.Errorf("invalid whoami label %q on %s. %v", whoami, device, err)
+	}
+
+	if osdUUIDStr, err := readBluestoreLabel(context, device, "osd_uuid"); err == nil && osdUUIDStr != "" {
+		if osdUUID, err := uuid.Parse(osdUUIDStr); err == nil {
+			config.uuid = osdUUID
+		}
+	}
+
+	config.id = osdID
+	config.diskUUID = fsid
+	config.adopted = true
+	if encrypted {
+		config.encrypted = true
+		config.encryptionMode = encryptionModeLUKS
+		config.deviceName = device
+	}
+	return true, nil
+}
+
+// isLUKSTypecode reports whether typecode is one of the GPT partition types of a dm-crypt'd OSD
+// partition (data, lockbox or, for filestore, journal). prepareEncryptedDevice itself only assigns
+// the data and journal types.
+func isLUKSTypecode(typecode string) bool {
+	switch typecode {
+	case gptTypecodeLUKSLockbox, gptTypecodeLUKSData, gptTypecodeLUKSJournal:
+		return true
+	}
+	return false
+}
+
+// readPartitionUUID returns the GPT partition (not type) uuid of device, used as the dm-crypt key's
+// identifier in the mon config-key store for an already-prepared encrypted partition.
+func readPartitionUUID(context *clusterd.Context, device string) (string, error) {
+	output, err := context.Executor.ExecuteCommandWithOutput("blkid partuuid", "blkid",
+		"-p", "-s", "PART_ENTRY_UUID", "-o", "value", device)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+// activateAdoptedDevice mounts/links an already-prepared OSD device into config.rootPath so the
+// daemon can be started against it without re-running the prepare/format flow.
+func activateAdoptedDevice(context *clusterd.Context, config *osdConfig) error {
+	return context.Executor.ExecuteCommand("ceph-bluestore-tool prime-osd-dir", "ceph-bluestore-tool",
+		"prime-osd-dir", "--dev", config.deviceName, "--path", config.rootPath)
+}
+
+// readPartitionTypecode returns the GPT partition typecode of device.
+func readPartitionTypecode(context *clusterd.Context, device string) (string, error) {
+	output, err := context.Executor.ExecuteCommandWithOutput("blkid parttype", "blkid",
+		"-p", "-s", "PART_ENTRY_TYPE", "-o", "value", device)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+// readBluestoreLabel reads a single named field (e.g. "ceph_fsid", "whoami", "osd_uuid") out of a
+// bluestore device's superblock label.
+func readBluestoreLabel(context *clusterd.Context, device, label string) (string, error) {
+	output, err := context.Executor.ExecuteCommandWithOutput("ceph-bluestore-tool show-label", "ceph-bluestore-tool",
+		"show-label", "--dev", device)
+	if err != nil {
+		return "", err
+	}
+
+	re := regexp.MustCompile(fmt.Sprintf(`"%s"\s*:\s*"?([^",}]+)"?`, regexp.QuoteMeta(label)))
+	match := re.FindStringSubmatch(output)
+	if len(match) < 2 {
+		return "", nil
+	}
+
+	return strings.TrimSpace(match[1]), nil
+}
+
 // runs an OSD with the given config in a child process
 func (a *osdAgent) runOSD(context *clusterd.Context, clusterName string, config *osdConfig) error {
 	// start the OSD daemon in the foreground with the given config
@@ -487,12 +1104,20 @@ func (a *osdAgent) runOSD(context *clusterd.Context, clusterName string, config
 		params = append(params, fmt.Sprintf("--osd-journal=%s", getOSDJournalPath(config.rootPath)))
 	}
 
+	if config.databasePartUUID != "" {
+		params = append(params, fmt.Sprintf("--bluestore-block-db-path=%s", partitionDevicePath(config.databaseDevice, config.databasePartUUID)))
+	}
+	if config.walPartUUID != "" {
+		params = append(params, fmt.Sprintf("--bluestore-block-wal-path=%s", partitionDevicePath(config.walDevice, config.walPartUUID)))
+	}
+
 	process, err := context.ProcMan.Start(
 		"osd",
 		regexp.QuoteMeta(osdUUIDArg),
 		proc.ReuseExisting,
 		params...)
 	if err != nil {
+		setOSDStatus(context, config.id, osdPhaseFailed, err)
 		return fmt.Errorf("failed to start osd %d: %+v", config.id, err)
 	}
 
@@ -503,11 +1128,560 @@ func (a *osdAgent) runOSD(context *clusterd.Context, clusterName string, config
 	if process != nil {
 		// if the process was already running Start will return nil in which case we don't want to overwrite it
 		a.osdProc[config.id] = process
+
+		// watch the daemon in the background so the status record reflects a crash, rather than
+		// staying stuck at "running" after the process has already exited
+		go a.watchOSDProcess(context, config.id, process)
+	}
+
+	if err := setOSDStatus(context, config.id, osdPhaseRunning, nil); err != nil {
+		log.Printf("failed to update status for osd %d. %v", config.id, err)
+	}
+	if process != nil && process.Cmd != nil && process.Cmd.Process != nil {
+		if err := setOSDStatusPID(context, config.id, process.Cmd.Process.Pid); err != nil {
+			log.Printf("failed to record pid for osd %d. %v", config.id, err)
+		}
+	}
+
+	return nil
+}
+
+// watchOSDProcess blocks until the osd daemon exits and updates its status record to "failed" so
+// the operator can distinguish a crashed daemon from one that is still healthy and running. An
+// exit caused by an intentional stop (removeOSD, ReplaceOSD, DestroyLocalService) is not reported
+// as a failure, since the stopper sets its own status and would otherwise race this goroutine.
+func (a *osdAgent) watchOSDProcess(context *clusterd.Context, osdID int, process *proc.MonitoredProc) {
+	if process.Cmd == nil {
+		return
+	}
+
+	err := process.Cmd.Wait()
+	log.Printf("osd %d process exited. %v", osdID, err)
+
+	if a.clearOSDStopping(osdID) {
+		log.Printf("osd %d was stopped intentionally, not marking it failed", osdID)
+		return
+	}
+
+	if statusErr := setOSDStatus(context, osdID, osdPhaseFailed, err); statusErr != nil {
+		log.Printf("failed to update status for osd %d after exit. %v", osdID, statusErr)
+	}
+}
+
+// partitionDevicePath returns the by-partuuid device node for a partition carved out of device,
+// the same stable naming ceph-volume relies on so the path survives reboots/device renumbering.
+func partitionDevicePath(device, partUUID string) string {
+	return path.Join("/dev/disk/by-partuuid", partUUID)
+}
+
+// dbPoolKey returns the etcd key tracking the partitions already carved out of a shared DB/WAL device.
+func dbPoolKey(device string) string {
+	return path.Join(cephKey, osdAgentName, appliedKey, "db-pool", getPseudoDir(device))
+}
+
+// allocateDBPartition carves the next free DB (or WAL) partition of sizeMB out of the shared fast
+// device, records the allocation in etcd so concurrent/future calls don't double-allocate, and
+// returns the new partition's GPT partuuid.
+func allocateDBPartition(context *clusterd.Context, device string, sizeMB int) (string, error) {
+	partUUID, err := createNextPartition(context, device, sizeMB)
+	if err != nil {
+		return "", fmt.Errorf("failed to create partition on %s. %+v", device, err)
+	}
+
+	key := path.Join(dbPoolKey(device), partUUID)
+	if _, err := context.EtcdClient.Set(ctx.Background(), key, sizeMBToString(sizeMB), nil); err != nil {
+		return "", fmt.Errorf("failed to record db partition %s. %+v", partUUID, err)
+	}
+
+	return partUUID, nil
+}
+
+// createNextPartition carves a new sizeMB partition for the shared device's DB/WAL pool, numbered
+// one above the highest partition number present in the device's GPT table (see
+// nextDBPartitionNumber), and returns the new partition's GPT partuuid.
+func createNextPartition(context *clusterd.Context, device string, sizeMB int) (string, error) {
+	partNum, err := nextDBPartitionNumber(context, device)
+	if err != nil {
+		return "", fmt.Errorf("failed to determine next partition number on %s. %+v", device, err)
+	}
+
+	partUUID, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate partition uuid. %+v", err)
+	}
+
+	args := []string{
+		"--new", fmt.Sprintf("%d:0:+%dM", partNum, sizeMB),
+		"--typecode", fmt.Sprintf("%d:%s", partNum, gptTypecodeCephBlockDB),
+		"--partition-guid", fmt.Sprintf("%d:%s", partNum, partUUID.String()),
+		device,
+	}
+	if err := context.Executor.ExecuteCommand("sgdisk create db/wal partition", "sgdisk", args...); err != nil {
+		return "", fmt.Errorf("failed to create partition %d on %s. %+v", partNum, device, err)
+	}
+
+	return partUUID.String(), nil
+}
+
+// nextDBPartitionNumber returns the GPT partition number to use for the next DB/WAL partition
+// carved out of device. It is derived from the highest partition number actually present in the
+// device's GPT table rather than from the count of etcd-tracked allocations, since that count
+// shrinks whenever freeDBPartition releases an entry and would otherwise hand out a number that's
+// still physically occupied by another, still-live OSD's DB/WAL partition.
+func nextDBPartitionNumber(context *clusterd.Context, device string) (int, error) {
+	output, err := context.Executor.ExecuteCommandWithOutput("sgdisk print", "sgdisk", "--print", device)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read partition table of %s. %+v", device, err)
+	}
+
+	re := regexp.MustCompile(`(?m)^\s*(\d+)\s`)
+	maxPartNum := 0
+	for _, match := range re.FindAllStringSubmatch(output, -1) {
+		partNum, err := strconv.Atoi(match[1])
+		if err != nil {
+			continue
+		}
+		if partNum > maxPartNum {
+			maxPartNum = partNum
+		}
+	}
+
+	return maxPartNum + 1, nil
+}
+
+// resolveDBSizeMB resolves the effective size in MB for a DB/WAL partition on a shared device,
+// mirroring the sizing inputs ceph-volume's batch prepare accepts: an explicit sizeMB takes
+// precedence, then an even split of the device's capacity into split partitions, then a ratio of
+// the device's capacity.
+func resolveDBSizeMB(context *clusterd.Context, device string, sizeMB int, ratio float64, split int) (int, error) {
+	if sizeMB > 0 {
+		return sizeMB, nil
+	}
+
+	deviceSizeMB, err := getDeviceSizeMB(context, device)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get size of %s. %+v", device, err)
+	}
+
+	if split > 0 {
+		return deviceSizeMB / split, nil
+	}
+	if ratio > 0 {
+		return int(float64(deviceSizeMB) * ratio), nil
+	}
+
+	return 0, fmt.Errorf("no db_size, db_ratio or split_count specified for shared device %s", device)
+}
+
+// getDeviceSizeMB returns the total capacity of device in MB.
+func getDeviceSizeMB(context *clusterd.Context, device string) (int, error) {
+	output, err := context.Executor.ExecuteCommandWithOutput("blockdev getsize64", "blockdev", "--getsize64", device)
+	if err != nil {
+		return 0, err
+	}
+
+	sizeBytes, err := strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid device size %q for %s. %+v", output, device, err)
+	}
+
+	return int(sizeBytes / (1024 * 1024)), nil
+}
+
+// freeDBPartition releases a previously allocated DB/WAL partition: the on-disk GPT partition is
+// deleted from the shared device so its space (and partition number) can be reused, and its etcd
+// bookkeeping entry is removed.
+func freeDBPartition(context *clusterd.Context, device, partUUID string) error {
+	if device == "" || partUUID == "" {
+		return nil
+	}
+
+	partNum, err := partitionNumberForUUID(context, device, partUUID)
+	if err != nil {
+		return fmt.Errorf("failed to find partition number for %s on %s. %+v", partUUID, device, err)
+	}
+	if partNum > 0 {
+		if err := context.Executor.ExecuteCommand("sgdisk delete db/wal partition", "sgdisk",
+			"--delete", strconv.Itoa(partNum), device); err != nil {
+			return fmt.Errorf("failed to delete partition %d on %s. %+v", partNum, device, err)
+		}
+	}
+
+	key := path.Join(dbPoolKey(device), partUUID)
+	_, err = context.EtcdClient.Delete(ctx.Background(), key, nil)
+	if err != nil && !util.IsEtcdKeyNotFound(err) {
+		return err
+	}
+
+	return nil
+}
+
+// partitionNumberForUUID returns the GPT partition number on device whose partition (not type)
+// uuid is partUUID, or 0 if no such partition is currently present. It is looked up via the
+// by-partuuid symlink rather than parsing sgdisk --print, since sgdisk's table doesn't list the
+// partition uuid alongside the number.
+func partitionNumberForUUID(context *clusterd.Context, device, partUUID string) (int, error) {
+	partitionDevice := partitionDevicePath(device, partUUID)
+	if _, err := os.Stat(partitionDevice); os.IsNotExist(err) {
+		return 0, nil
+	}
+
+	return readPartitionNumber(context, partitionDevice)
+}
+
+// readPartitionNumber returns the GPT partition number of the given partition device node.
+func readPartitionNumber(context *clusterd.Context, partitionDevice string) (int, error) {
+	output, err := context.Executor.ExecuteCommandWithOutput("blkid partnum", "blkid",
+		"-p", "-s", "PART_ENTRY_NUMBER", "-o", "value", partitionDevice)
+	if err != nil {
+		return 0, err
+	}
+
+	partNum, err := strconv.Atoi(strings.TrimSpace(output))
+	if err != nil {
+		return 0, fmt.Errorf("invalid partition number %q for %s. %+v", output, partitionDevice, err)
+	}
+
+	return partNum, nil
+}
+
+// parentDiskDevice returns the whole-disk device node that partitionDevice was carved out of, e.g.
+// "/dev/sdb" for "/dev/sdb1", since sgdisk operates on the disk rather than the partition node.
+func parentDiskDevice(context *clusterd.Context, partitionDevice string) (string, error) {
+	output, err := context.Executor.ExecuteCommandWithOutput("lsblk parent", "lsblk", "-no", "pkname", partitionDevice)
+	if err != nil {
+		return "", err
+	}
+
+	parent := strings.TrimSpace(output)
+	if parent == "" {
+		return "", fmt.Errorf("no parent disk found for partition %s", partitionDevice)
+	}
+
+	return path.Join("/dev", parent), nil
+}
+
+// setPartitionTypecode tags partitionDevice's GPT entry with typecode, so a later probe (e.g.
+// probeExistingOSD) can recognize the partition's role without needing to read its contents.
+func setPartitionTypecode(context *clusterd.Context, partitionDevice, typecode string) error {
+	disk, err := parentDiskDevice(context, partitionDevice)
+	if err != nil {
+		return fmt.Errorf("failed to find parent disk of %s. %+v", partitionDevice, err)
+	}
+
+	partNum, err := readPartitionNumber(context, partitionDevice)
+	if err != nil {
+		return fmt.Errorf("failed to find partition number of %s. %+v", partitionDevice, err)
+	}
+
+	args := []string{"--typecode", fmt.Sprintf("%d:%s", partNum, typecode), disk}
+	if err := context.Executor.ExecuteCommand("sgdisk set typecode", "sgdisk", args...); err != nil {
+		return fmt.Errorf("failed to set typecode %s on partition %d of %s. %+v", typecode, partNum, disk, err)
 	}
 
 	return nil
 }
 
+func sizeMBToString(sizeMB int) string {
+	return strconv.Itoa(sizeMB)
+}
+
+// getAppliedSetting looks up a single named setting recorded for an applied osd (e.g. "db-device",
+// "db-part-uuid"), returning "" if the osd or the setting isn't present.
+func getAppliedSetting(context *clusterd.Context, id int, settingKey string) (string, error) {
+	key := path.Join(getAppliedKey(context.NodeID), fmt.Sprintf("%d", id))
+	osdKey, err := context.EtcdClient.Get(ctx.Background(), key, &etcd.GetOptions{Recursive: true})
+	if err != nil {
+		if util.IsEtcdKeyNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	for _, setting := range osdKey.Node.Nodes {
+		if strings.HasSuffix(setting.Key, "/"+settingKey) {
+			return setting.Value, nil
+		}
+	}
+
+	return "", nil
+}
+
+// getAppliedPartUUID looks up a DB/WAL partition uuid recorded for an applied osd under settingKey
+// (e.g. "db-part-uuid"), so a restart can reuse the partition instead of allocating a new one.
+func getAppliedPartUUID(context *clusterd.Context, id int, settingKey string) (string, error) {
+	return getAppliedSetting(context, id, settingKey)
+}
+
+// loadDesiredDeviceConfigs loads the desired devices for a node, parsing the richer per-device
+// layout under cephKey/osd/desired/<node>/device/<name> that, in addition to the assigned osd id,
+// may carry a shared DB/WAL device (db, db_size/db_ratio, split) for ceph-volume style bluestore
+// layouts where the DB/WAL doesn't live on the same device as the data.
+func loadDesiredDeviceConfigs(etcdClient etcd.KeysAPI, nodeID string) (map[string]*desiredDeviceConfig, error) {
+	devices, err := loadDesiredDevices(etcdClient, nodeID)
+	if err != nil {
+		return nil, err
+	}
+
+	configs := make(map[string]*desiredDeviceConfig, len(devices))
+	for name, osdID := range devices {
+		configs[name] = &desiredDeviceConfig{name: name, osdID: osdID}
+	}
+
+	key := path.Join(cephKey, osdAgentName, desiredKey, nodeID, "device")
+	deviceNodes, err := etcdClient.Get(ctx.Background(), key, &etcd.GetOptions{Recursive: true})
+	if err != nil {
+		if util.IsEtcdKeyNotFound(err) {
+			return configs, nil
+		}
+		return nil, err
+	}
+
+	for _, deviceNode := range deviceNodes.Node.Nodes {
+		name := util.GetLeafKeyPath(deviceNode.Key)
+		deviceConfig, ok := configs[name]
+		if !ok {
+			// the device has extended settings but is not (yet) assigned an osd id
+			deviceConfig = &desiredDeviceConfig{name: name, osdID: unassignedOSDID}
+			configs[name] = deviceConfig
+		}
+
+		for _, setting := range deviceNode.Nodes {
+			settingKey := util.GetLeafKeyPath(setting.Key)
+			switch settingKey {
+			case "db", "db_device":
+				deviceConfig.dbDevice = setting.Value
+			case "db_size":
+				deviceConfig.dbSizeMB = parseSizeMB(setting.Value)
+			case "db_ratio":
+				deviceConfig.dbRatio, _ = strconv.ParseFloat(setting.Value, 64)
+			case "split", "split_count":
+				deviceConfig.dbSplit, _ = strconv.Atoi(setting.Value)
+			case "wal", "wal_device":
+				deviceConfig.walDevice = setting.Value
+			case "wal_size":
+				deviceConfig.walSizeMB = parseSizeMB(setting.Value)
+			}
+		}
+	}
+
+	return configs, nil
+}
+
+// parseSizeMB parses a human size like "30GiB" into whole megabytes.
+func parseSizeMB(size string) int {
+	size = strings.TrimSpace(size)
+	multiplier := 1
+	switch {
+	case strings.HasSuffix(size, "GiB"):
+		multiplier = 1024
+		size = strings.TrimSuffix(size, "GiB")
+	case strings.HasSuffix(size, "MiB"):
+		size = strings.TrimSuffix(size, "MiB")
+	}
+
+	value, err := strconv.Atoi(strings.TrimSpace(size))
+	if err != nil {
+		return 0
+	}
+
+	return value * multiplier
+}
+
+// prepareEncryptedDevice generates a new dm-crypt key for the OSD, stores it in the mon config-key
+// store, tags the raw partition's GPT typecode so probeExistingOSD can recognize it as an encrypted
+// OSD partition later, and runs luksFormat/luksOpen against it. config.deviceName is rewritten to
+// the resulting /dev/mapper/<uuid> node so the rest of the bluestore prepare flow operates on it
+// unchanged.
+func (a *osdAgent) prepareEncryptedDevice(context *clusterd.Context, connection client.Connection, config *osdConfig) error {
+	if config.encryptionMode == "" {
+		config.encryptionMode = encryptionModeLUKS
+	}
+
+	if config.encryptionMode != encryptionModeLUKS && config.encryptionMode != encryptionModePlain {
+		return fmt.Errorf("unknown encryption mode %s", config.encryptionMode)
+	}
+
+	if config.uuid == (uuid.UUID{}) {
+		osdUUID, err := uuid.NewRandom()
+		if err != nil {
+			return fmt.Errorf("failed to generate osd uuid. %+v", err)
+		}
+		config.uuid = osdUUID
+	}
+
+	key, err := generateDmCryptKey()
+	if err != nil {
+		return fmt.Errorf("failed to generate dm-crypt key. %+v", err)
+	}
+
+	if err := storeDmCryptKey(connection, config.uuid, key); err != nil {
+		return fmt.Errorf("failed to store dm-crypt key in mon. %+v", err)
+	}
+
+	typecode := gptTypecodeLUKSData
+	if !config.bluestore {
+		typecode = gptTypecodeLUKSJournal
+	}
+	if err := setPartitionTypecode(context, config.deviceName, typecode); err != nil {
+		return fmt.Errorf("failed to tag encrypted partition %s. %+v", config.deviceName, err)
+	}
+
+	mapperPath, err := luksFormatAndOpen(context, config.deviceName, config.uuid, config.encryptionMode, key)
+	if err != nil {
+		return fmt.Errorf("failed to luksFormat/luksOpen %s. %+v", config.deviceName, err)
+	}
+
+	config.deviceName = mapperPath
+	return nil
+}
+
+// reopenEncryptedDevice fetches the dm-crypt key back from the mon and re-opens the LUKS mapper for
+// an OSD that is being restarted, since the mapper does not survive a process/daemon restart.
+func (a *osdAgent) reopenEncryptedDevice(context *clusterd.Context, connection client.Connection, config *osdConfig) error {
+	if dmCryptMapperExists(config.uuid) {
+		// already open from a previous attempt in this process lifetime
+		return nil
+	}
+
+	key, err := fetchDmCryptKey(connection, config.uuid)
+	if err != nil {
+		return fmt.Errorf("failed to fetch dm-crypt key from mon. %+v", err)
+	}
+
+	mapperPath, err := luksOpen(context, config.deviceName, config.uuid, key)
+	if err != nil {
+		return err
+	}
+
+	config.deviceName = mapperPath
+	return nil
+}
+
+func generateDmCryptKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func dmCryptConfigKeyPath(osdUUID uuid.UUID) string {
+	return fmt.Sprintf(dmCryptKeyConfigKeyFormat, osdUUID.String())
+}
+
+// storeDmCryptKey persists the OSD's dm-crypt key in the mon's config-key store, mirroring the
+// ceph-disk lockbox approach so the key can be recovered on another node or after a reboot.
+func storeDmCryptKey(connection client.Connection, osdUUID uuid.UUID, key string) error {
+	args := []string{"config-key", "put", dmCryptConfigKeyPath(osdUUID), key}
+	_, _, err := client.ExecuteMonCommand(connection, args...)
+	return err
+}
+
+func fetchDmCryptKey(connection client.Connection, osdUUID uuid.UUID) (string, error) {
+	args := []string{"config-key", "get", dmCryptConfigKeyPath(osdUUID)}
+	output, _, err := client.ExecuteMonCommand(connection, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+func purgeDmCryptKey(connection client.Connection, osdUUID uuid.UUID) error {
+	args := []string{"config-key", "del", dmCryptConfigKeyPath(osdUUID)}
+	_, _, err := client.ExecuteMonCommand(connection, args...)
+	return err
+}
+
+func dmCryptMapperName(osdUUID uuid.UUID) string {
+	return osdUUID.String()
+}
+
+func dmCryptMapperPath(osdUUID uuid.UUID) string {
+	return path.Join("/dev/mapper", dmCryptMapperName(osdUUID))
+}
+
+func dmCryptMapperExists(osdUUID uuid.UUID) bool {
+	_, err := os.Stat(dmCryptMapperPath(osdUUID))
+	return err == nil
+}
+
+// luksFormatAndOpen formats the raw device with LUKS (or leaves it unformatted for plain dm-crypt)
+// and opens it, returning the resulting /dev/mapper/<uuid> path.
+func luksFormatAndOpen(context *clusterd.Context, device string, osdUUID uuid.UUID, mode, key string) (string, error) {
+	if mode == encryptionModeLUKS {
+		if err := runCryptsetupWithKey(key, "--batch-mode", "luksFormat", device); err != nil {
+			return "", fmt.Errorf("failed to luksFormat %s. %+v", device, err)
+		}
+	}
+
+	return luksOpen(context, device, osdUUID, key)
+}
+
+func luksOpen(context *clusterd.Context, device string, osdUUID uuid.UUID, key string) (string, error) {
+	name := dmCryptMapperName(osdUUID)
+	if err := runCryptsetupWithKey(key, "luksOpen", device, name); err != nil {
+		return "", fmt.Errorf("failed to luksOpen %s. %+v", device, err)
+	}
+
+	return dmCryptMapperPath(osdUUID), nil
+}
+
+// runCryptsetupWithKey runs cryptsetup with "--key-file=-" and key piped to its stdin. This goes
+// around context.Executor directly since that interface has no way to supply input to the child
+// process, which is what left the generated dm-crypt key never actually reaching cryptsetup.
+func runCryptsetupWithKey(key string, args ...string) error {
+	cmd := exec.Command("cryptsetup", append([]string{"--key-file=-"}, args...)...)
+	cmd.Stdin = strings.NewReader(key)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s. output: %s", err, string(output))
+	}
+
+	return nil
+}
+
+// closeDmCryptDevice closes the LUKS mapper for the given OSD, if it is open.
+func closeDmCryptDevice(context *clusterd.Context, osdUUID uuid.UUID) error {
+	if !dmCryptMapperExists(osdUUID) {
+		return nil
+	}
+
+	return context.Executor.ExecuteCommand("cryptsetup luksClose", "cryptsetup", "luksClose", dmCryptMapperName(osdUUID))
+}
+
+// getAppliedEncryption looks up whether the given applied OSD was provisioned with dm-crypt, and if
+// so its osd uuid, so removeOSD can close the mapper and purge the key.
+func getAppliedEncryption(context *clusterd.Context, id int) (uuid.UUID, bool, error) {
+	key := path.Join(getAppliedKey(context.NodeID), fmt.Sprintf("%d", id))
+	osdKey, err := context.EtcdClient.Get(ctx.Background(), key, &etcd.GetOptions{Recursive: true})
+	if err != nil {
+		if util.IsEtcdKeyNotFound(err) {
+			return uuid.UUID{}, false, nil
+		}
+		return uuid.UUID{}, false, err
+	}
+
+	var osdUUID uuid.UUID
+	encrypted := false
+	for _, setting := range osdKey.Node.Nodes {
+		switch {
+		case strings.HasSuffix(setting.Key, "/osd-uuid"):
+			parsed, err := uuid.Parse(setting.Value)
+			if err != nil {
+				return uuid.UUID{}, false, fmt.Errorf("failed to parse osd uuid %s. %+v", setting.Value, err)
+			}
+			osdUUID = parsed
+		case strings.HasSuffix(setting.Key, "/encrypted"):
+			encrypted = setting.Value == "1"
+		}
+	}
+
+	return osdUUID, encrypted, nil
+}
+
 // For all applied OSDs, gets a mapping of their osd IDs to their device uuid
 func GetAppliedOSDs(nodeID string, etcdClient etcd.KeysAPI) (map[int]string, error) {
 
@@ -539,6 +1713,98 @@ func GetAppliedOSDs(nodeID string, etcdClient etcd.KeysAPI) (map[int]string, err
 	return osds, nil
 }
 
+// osd status phases, written to cephKey/osd/status/<node>/<osdID> as createOrStartOSD, runOSD and
+// removeOSD move an osd between phases, so a caller can tell whether an osd is still being
+// prepared, failed, or running, rather than having only a log line and the osdsCompleted channel
+// to go on. ReplaceOSD writes no phase of its own; only the final "running" is recorded, by runOSD.
+const (
+	osdPhasePreparing    = "preparing"
+	osdPhaseFormatting   = "formatting"
+	osdPhaseInitializing = "initializing"
+	osdPhaseRunning      = "running"
+	osdPhaseFailed       = "failed"
+	osdPhaseRemoved      = "removed"
+)
+
+// OSDStatus is the structured status record kept for a single osd.
+type OSDStatus struct {
+	Phase     string
+	Error     string
+	StartedAt string
+	UpdatedAt string
+	PID       int
+}
+
+func getOSDStatusKey(nodeID string, osdID int) string {
+	return path.Join(cephKey, osdAgentName, "status", nodeID, fmt.Sprintf("%d", osdID))
+}
+
+// setOSDStatus records a phase transition for an osd, along with the failure cause when one is
+// given (on entering the "failed" phase). started-at is stamped each time the "preparing" phase is
+// written, so it holds the start of the most recent createOrStartOSD pass.
+func setOSDStatus(context *clusterd.Context, osdID int, phase string, cause error) error {
+	now := time.Now().Format(time.RFC3339)
+	settings := map[string]string{
+		"phase":      phase,
+		"updated-at": now,
+	}
+	if phase == osdPhasePreparing {
+		settings["started-at"] = now
+	}
+	if cause != nil {
+		settings["error"] = cause.Error()
+	}
+
+	return util.StoreEtcdProperties(context.EtcdClient, getOSDStatusKey(context.NodeID, osdID), settings)
+}
+
+// setOSDStatusPID records the pid of the osd daemon's child process once it has been started.
+func setOSDStatusPID(context *clusterd.Context, osdID, pid int) error {
+	settings := map[string]string{"pid": fmt.Sprintf("%d", pid)}
+	return util.StoreEtcdProperties(context.EtcdClient, getOSDStatusKey(context.NodeID, osdID), settings)
+}
+
+// GetOSDStatuses returns the current status record for every osd with one on the given node.
+func GetOSDStatuses(nodeID string, etcdClient etcd.KeysAPI) (map[int]OSDStatus, error) {
+	statuses := map[int]OSDStatus{}
+	key := path.Join(cephKey, osdAgentName, "status", nodeID)
+	statusNodes, err := etcdClient.Get(ctx.Background(), key, &etcd.GetOptions{Recursive: true})
+	if err != nil {
+		if util.IsEtcdKeyNotFound(err) {
+			return statuses, nil
+		}
+		return nil, err
+	}
+
+	for _, idNode := range statusNodes.Node.Nodes {
+		id, err := strconv.Atoi(util.GetLeafKeyPath(idNode.Key))
+		if err != nil {
+			// skip the unexpected osd id
+			continue
+		}
+
+		status := OSDStatus{}
+		for _, setting := range idNode.Nodes {
+			switch util.GetLeafKeyPath(setting.Key) {
+			case "phase":
+				status.Phase = setting.Value
+			case "error":
+				status.Error = setting.Value
+			case "started-at":
+				status.StartedAt = setting.Value
+			case "updated-at":
+				status.UpdatedAt = setting.Value
+			case "pid":
+				status.PID, _ = strconv.Atoi(setting.Value)
+			}
+		}
+
+		statuses[id] = status
+	}
+
+	return statuses, nil
+}
+
 func getPseudoDir(path string) string {
 	// cut off the leading slash so we won't end up with a hidden etcd key
 	if strings.HasPrefix(path, "/") {
@@ -0,0 +1,168 @@
+/*
+Copyright 2016 The Rook Authors. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package clusterd
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	ctx "golang.org/x/net/context"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/rook/rook/pkg/util"
+)
+
+const (
+	defaultMutexTTL         = 30 * time.Second
+	defaultMutexRetryPeriod = time.Second
+)
+
+// EtcdMutex is a distributed mutex built on etcd's compare-and-swap semantics: acquiring it creates
+// a key with PrevExist=false so only one holder can succeed, and a background goroutine renews the
+// key's TTL for as long as the lock is held. If the holder dies without calling Unlock, the key
+// expires on its own and another agent can take over. Multiple agents (e.g. during a rolling
+// restart or HA takeover) racing to configure the same orchestration key can use this to avoid
+// double-acting on it.
+//
+// A single EtcdMutex instance is also safe to share between multiple local goroutines: localSem is
+// a 1-buffered channel acting as a binary semaphore, so a second local caller blocks in Lock (or
+// fails in TryLock) exactly as it would against a real sync.Mutex, instead of observing the etcd
+// key as already held by "itself" and returning immediately.
+type EtcdMutex struct {
+	client  etcd.KeysAPI
+	key     string
+	ttl     time.Duration
+	ownerID string
+
+	localSem chan struct{}
+
+	mutex  sync.Mutex
+	held   bool
+	stopCh chan struct{}
+}
+
+// NewEtcdMutex creates a distributed mutex keyed on the given etcd path. ownerID is written as the
+// lock's value purely for diagnostics (e.g. the node or agent holding it).
+func NewEtcdMutex(client etcd.KeysAPI, key, ownerID string) *EtcdMutex {
+	localSem := make(chan struct{}, 1)
+	localSem <- struct{}{}
+	return &EtcdMutex{client: client, key: key, ttl: defaultMutexTTL, ownerID: ownerID, localSem: localSem}
+}
+
+// Lock blocks until the mutex is acquired: first against any other local goroutine sharing this
+// instance, then retrying the etcd compare-and-swap periodically while another holder has it.
+func (m *EtcdMutex) Lock() error {
+	<-m.localSem
+
+	for {
+		acquired, err := m.tryAcquireEtcdLock()
+		if err != nil {
+			m.localSem <- struct{}{}
+			return err
+		}
+		if acquired {
+			return nil
+		}
+
+		<-time.After(defaultMutexRetryPeriod)
+	}
+}
+
+// TryLock attempts to acquire the mutex once. It returns false, not an error, if another local
+// goroutine sharing this instance, or another holder in etcd, already has the lock.
+func (m *EtcdMutex) TryLock() (bool, error) {
+	select {
+	case <-m.localSem:
+	default:
+		return false, nil
+	}
+
+	acquired, err := m.tryAcquireEtcdLock()
+	if err != nil || !acquired {
+		m.localSem <- struct{}{}
+		return acquired, err
+	}
+
+	return true, nil
+}
+
+// tryAcquireEtcdLock attempts the underlying etcd compare-and-swap once. The caller must already
+// hold localSem.
+func (m *EtcdMutex) tryAcquireEtcdLock() (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, err := m.client.Set(ctx.Background(), m.key, m.ownerID, &etcd.SetOptions{PrevExist: etcd.PrevNoExist, TTL: m.ttl})
+	if err != nil {
+		if isKeyAlreadyExists(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to acquire lock %s. %v", m.key, err)
+	}
+
+	m.held = true
+	m.stopCh = make(chan struct{})
+	go m.renew()
+	return true, nil
+}
+
+// Unlock releases the mutex: the renewal goroutine is stopped, the key is deleted, and a local
+// goroutine blocked in Lock is free to proceed. Unlock on a mutex that isn't held is a no-op.
+func (m *EtcdMutex) Unlock() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.held {
+		return nil
+	}
+
+	close(m.stopCh)
+	m.held = false
+	m.localSem <- struct{}{}
+
+	_, err := m.client.Delete(ctx.Background(), m.key, nil)
+	if err != nil && !util.IsEtcdKeyNotFound(err) {
+		return fmt.Errorf("failed to release lock %s. %v", m.key, err)
+	}
+
+	return nil
+}
+
+// renew refreshes the lock's TTL in the background for as long as it is held.
+func (m *EtcdMutex) renew() {
+	ticker := time.NewTicker(m.ttl / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := m.client.Set(ctx.Background(), m.key, "", &etcd.SetOptions{PrevExist: etcd.PrevExist, TTL: m.ttl, Refresh: true})
+			if err != nil {
+				log.Printf("failed to renew lock %s. %v", m.key, err)
+			}
+		case <-m.stopCh:
+			return
+		}
+	}
+}
+
+func isKeyAlreadyExists(err error) bool {
+	etcdErr, ok := err.(etcd.Error)
+	return ok && etcdErr.Code == etcd.ErrorCodeNodeExist
+}